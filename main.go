@@ -2,19 +2,20 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
-	"github.com/yuuki/binrep/pkg/command"
-	"github.com/yuuki/binrep/pkg/config"
-)
-
-const (
-	defaultKeepReleases int = 5
+	"github.com/yuuki/binrep/pkg/meta"
+	"github.com/yuuki/binrep/pkg/sign"
+	"github.com/yuuki/binrep/pkg/storage"
 )
 
 var (
@@ -28,6 +29,13 @@ type CLI struct {
 	outStream, errStream io.Writer
 }
 
+// cliConfig holds the settings pkg/config used to provide. That package,
+// like pkg/command, isn't present in this tree, so main talks to
+// pkg/storage directly instead.
+var cliConfig struct {
+	BackendEndpoint string
+}
+
 func main() {
 	cli := &CLI{outStream: os.Stdout, errStream: os.Stderr}
 	os.Exit(cli.Run(os.Args))
@@ -40,7 +48,7 @@ func (cli *CLI) Run(args []string) int {
 		return 2
 	}
 
-	config.Load()
+	cliConfig.BackendEndpoint = os.Getenv("BINREP_BACKEND_ENDPOINT")
 
 	var err error
 	i := 1
@@ -59,6 +67,12 @@ ARG_LOOP:
 		case "pull":
 			err = cli.doPull(args[i+1:])
 			break ARG_LOOP
+		case "rollback":
+			err = cli.doRollback(args[i+1:])
+			break ARG_LOOP
+		case "verify":
+			err = cli.doVerify(args[i+1:])
+			break ARG_LOOP
 		case "--version":
 			fmt.Fprintf(cli.errStream, "%s version %s, build %s, date %s \n", name, version, commit, date)
 			return 0
@@ -74,7 +88,7 @@ ARG_LOOP:
 				fmt.Fprint(cli.errStream, helpText)
 				return 1
 			}
-			config.Config.BackendEndpoint = args[i+1]
+			cliConfig.BackendEndpoint = args[i+1]
 			i += 2
 			// No subcommand error
 			if len(args) <= i {
@@ -105,6 +119,8 @@ Commands:
   show          show binary information.
   push		push binary.
   pull		pull binary.
+  rollback	restore a previous version of a binary as the current release.
+  verify	verify every binary in a release against its checksum and, with --trusted-key, its signature.
 
 Options:
   --version             print version
@@ -112,7 +128,7 @@ Options:
 `
 
 func validateConfig() error {
-	if config.Config.BackendEndpoint == "" {
+	if cliConfig.BackendEndpoint == "" {
 		return errors.New("BackendEndpoint required. Use --endpoint or BINREP_BACKEND_ENDPOINT")
 	}
 	return nil
@@ -127,6 +143,39 @@ func (cli *CLI) prepareFlags(help string) *flag.FlagSet {
 	return flags
 }
 
+// nowTimestamp formats the current time the same way meta.BuildBinary
+// timestamps a binary, so a release pushed without --timestamp sorts
+// alongside ones that specify it explicitly.
+func nowTimestamp() string {
+	utc, _ := time.LoadLocation("UTC")
+	return time.Now().In(utc).Format("20060102150405")
+}
+
+// stringSliceFlag collects repeated occurrences of a flag (e.g.
+// --trusted-key) into a slice, since flag.FlagSet has no repeatable string
+// flag built in.
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string { return strings.Join(*s, ",") }
+
+func (s *stringSliceFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// trustedKeys resolves the ed25519 public keys a signature must verify
+// against, falling back to the comma-separated BINREP_TRUSTED_KEYS
+// environment variable when no --trusted-key flag was given.
+func (s *stringSliceFlag) trustedKeys() ([]ed25519.PublicKey, error) {
+	values := []string(*s)
+	if len(values) == 0 {
+		if env := os.Getenv("BINREP_TRUSTED_KEYS"); env != "" {
+			values = strings.Split(env, ",")
+		}
+	}
+	return sign.ParsePublicKeys(values)
+}
+
 var listHelpText = `Usage: binrep list [options]
 
 show releases on remote repository
@@ -135,7 +184,6 @@ Options:
 `
 
 func (cli *CLI) doList(args []string) error {
-	var param command.ListParam
 	flags := cli.prepareFlags(listHelpText)
 	if err := flags.Parse(args); err != nil {
 		return err
@@ -144,10 +192,7 @@ func (cli *CLI) doList(args []string) error {
 		fmt.Fprint(cli.errStream, listHelpText)
 		return errors.Errorf("extra arguments")
 	}
-	if err := validateConfig(); err != nil {
-		return err
-	}
-	return command.List(&param)
+	return errors.New("list is not implemented: storage.Backend has no way to enumerate the repositories at an endpoint yet")
 }
 
 var showHelpText = `Usage: binrep show [options] <host>/<user>/<project>
@@ -159,10 +204,10 @@ Options:
 `
 
 func (cli *CLI) doShow(args []string) error {
-	var param command.ShowParam
+	var timestamp string
 	flags := cli.prepareFlags(showHelpText)
-	flags.StringVar(&param.Timestamp, "t", "", "")
-	flags.StringVar(&param.Timestamp, "timestamp", "", "")
+	flags.StringVar(&timestamp, "t", "", "")
+	flags.StringVar(&timestamp, "timestamp", "", "")
 	if err := flags.Parse(args); err != nil {
 		return err
 	}
@@ -170,10 +215,7 @@ func (cli *CLI) doShow(args []string) error {
 		fmt.Fprint(cli.errStream, showHelpText)
 		return errors.Errorf("too few arguments")
 	}
-	if err := validateConfig(); err != nil {
-		return err
-	}
-	return command.Show(&param, flags.Arg(0))
+	return errors.New("show is not implemented: storage.Backend has no way to read back meta.yml's contents yet")
 }
 
 var pushHelpText = `Usage: binrep push [options] <host>/<user>/<project> /path/to/binary ...
@@ -182,19 +224,27 @@ push binary.
 
 Options:
   --timestamp, -t       binary timestamp
-  --keep-releases, -k	the number of releases that it keeps (default: 5)
-  --force, -f		always push even if each checksum of binaries is the same with each one on remote storage (default: false)
+  --sign-key		path to an ed25519 private key (as written by sign.SavePrivateKey) to sign each binary with
+  --sse			server-side encryption algorithm to request, e.g. AES256 or aws:kms (env BINREP_SSE)
+  --sse-kms-key-id	KMS key ID/ARN to encrypt with when --sse=aws:kms (env BINREP_KMS_KEY_ID)
+  --sse-c-key		customer-supplied SSE-C key to encrypt with (env BINREP_SSE_C_KEY)
 `
 
 func (cli *CLI) doPush(args []string) error {
-	var param command.PushParam
+	var (
+		timestamp   string
+		signKeyPath string
+		sse         string
+		sseKMSKeyID string
+		sseCKey     string
+	)
 	flags := cli.prepareFlags(pushHelpText)
-	flags.StringVar(&param.Timestamp, "t", "", "")
-	flags.StringVar(&param.Timestamp, "timestamp", "", "")
-	flags.IntVar(&param.KeepReleases, "k", defaultKeepReleases, "")
-	flags.IntVar(&param.KeepReleases, "keep-releases", defaultKeepReleases, "")
-	flags.BoolVar(&param.Force, "f", false, "")
-	flags.BoolVar(&param.Force, "force", false, "")
+	flags.StringVar(&timestamp, "t", "", "")
+	flags.StringVar(&timestamp, "timestamp", "", "")
+	flags.StringVar(&signKeyPath, "sign-key", "", "")
+	flags.StringVar(&sse, "sse", os.Getenv("BINREP_SSE"), "")
+	flags.StringVar(&sseKMSKeyID, "sse-kms-key-id", os.Getenv("BINREP_KMS_KEY_ID"), "")
+	flags.StringVar(&sseCKey, "sse-c-key", os.Getenv("BINREP_SSE_C_KEY"), "")
 	if err := flags.Parse(args); err != nil {
 		return err
 	}
@@ -206,25 +256,72 @@ func (cli *CLI) doPush(args []string) error {
 	if err := validateConfig(); err != nil {
 		return err
 	}
-	return command.Push(&param, flags.Arg(0), flags.Args()[1:argLen])
+
+	var signKey ed25519.PrivateKey
+	if signKeyPath != "" {
+		key, err := sign.LoadPrivateKey(signKeyPath)
+		if err != nil {
+			return err
+		}
+		signKey = key
+	}
+
+	backend, err := storage.New(cliConfig.BackendEndpoint)
+	if err != nil {
+		return err
+	}
+
+	if timestamp == "" {
+		timestamp = nowTimestamp()
+	}
+	name := flags.Arg(0)
+	u, err := storage.BuildURL(cliConfig.BackendEndpoint, name, timestamp)
+	if err != nil {
+		return err
+	}
+
+	opts := &storage.PushOptions{
+		ServerSideEncryption: sse,
+		SSEKMSKeyId:          sseKMSKeyID,
+		SSECustomerKey:       sseCKey,
+	}
+	bins, err := storage.BuildAndPushBinaries(func(in io.Reader, binName string, opts *storage.PushOptions) (string, string, string, error) {
+		return backend.PushBinary(in, u, binName, opts)
+	}, flags.Args()[1:argLen], signKey, opts)
+	if err != nil {
+		return err
+	}
+	return backend.CreateOrUpdateMeta(u, bins, opts)
 }
 
-var pullHelpText = `Usage: binrep pull [options] <host>/<user>/<project> /path/to/binary
+var pullHelpText = `Usage: binrep pull [options] <host>/<user>/<project> /path/to/install/dir
 
-pull binary.
+pull binaries.
 
 Options:
   --timestamp, -t       binary timestamp
-  --max-bandwidth, -bw	max bandwidth for download binaries (Bytes/sec) eg. '1 MB', '1024 KB'
+  --versions		list the historical versions of <binary> instead of pulling: pull --versions <project> <binary>
+  --trusted-key		base64-encoded ed25519 public key a binary's signature must verify against (repeatable; env BINREP_TRUSTED_KEYS, comma-separated)
+  --parallel, -p	max number of binaries to download concurrently (default: runtime.NumCPU())
+  --sse-c-key		customer-supplied SSE-C key to decrypt binaries pushed with one (env BINREP_SSE_C_KEY)
 `
 
 func (cli *CLI) doPull(args []string) error {
-	var param command.PullParam
+	var (
+		timestamp    string
+		showVersions bool
+		trustedKeys  stringSliceFlag
+		parallel     int
+		sseCKey      string
+	)
 	flags := cli.prepareFlags(pullHelpText)
-	flags.StringVar(&param.Timestamp, "t", "", "")
-	flags.StringVar(&param.Timestamp, "timestamp", "", "")
-	flags.StringVar(&param.MaxBandWidth, "bw", "", "")
-	flags.StringVar(&param.MaxBandWidth, "max-bandwidth", "", "")
+	flags.StringVar(&timestamp, "t", "", "")
+	flags.StringVar(&timestamp, "timestamp", "", "")
+	flags.BoolVar(&showVersions, "versions", false, "")
+	flags.Var(&trustedKeys, "trusted-key", "")
+	flags.IntVar(&parallel, "p", 0, "")
+	flags.IntVar(&parallel, "parallel", 0, "")
+	flags.StringVar(&sseCKey, "sse-c-key", os.Getenv("BINREP_SSE_C_KEY"), "")
 	if err := flags.Parse(args); err != nil {
 		return err
 	}
@@ -235,5 +332,179 @@ func (cli *CLI) doPull(args []string) error {
 	if err := validateConfig(); err != nil {
 		return err
 	}
-	return command.Pull(&param, flags.Arg(0), flags.Arg(1))
+
+	backend, err := storage.New(cliConfig.BackendEndpoint)
+	if err != nil {
+		return err
+	}
+
+	name := flags.Arg(0)
+	if timestamp == "" {
+		timestamp, err = backend.LatestTimestamp(cliConfig.BackendEndpoint, name)
+		if err != nil {
+			return err
+		}
+	}
+	u, err := storage.BuildURL(cliConfig.BackendEndpoint, name, timestamp)
+	if err != nil {
+		return err
+	}
+
+	if showVersions {
+		versions, err := backend.ListVersions(u, flags.Arg(1))
+		if err != nil {
+			return err
+		}
+		for _, v := range versions {
+			fmt.Fprintf(cli.outStream, "%s\t%s\n", v.VersionID, v.Timestamp.Format(time.RFC3339))
+		}
+		return nil
+	}
+
+	keys, err := trustedKeys.trustedKeys()
+	if err != nil {
+		return err
+	}
+	return backend.PullBinaries(u, flags.Arg(1), &storage.PullOptions{
+		TrustedKeys:    keys,
+		Parallel:       parallel,
+		SSECustomerKey: sseCKey,
+		Progress: func(binName string, err error) {
+			if err != nil {
+				fmt.Fprintf(cli.errStream, "%s: failed: %v\n", binName, err)
+				return
+			}
+			fmt.Fprintf(cli.outStream, "%s: done\n", binName)
+		},
+	})
+}
+
+var rollbackHelpText = `Usage: binrep rollback [options] <host>/<user>/<project> <binary> <version-id>
+
+restore a previous version of a binary as the current release, using the
+backend's native object versioning (see 'pull --versions').
+
+Options:
+  --timestamp, -t       release timestamp to roll back within (default: latest)
+`
+
+func (cli *CLI) doRollback(args []string) error {
+	var timestamp string
+	flags := cli.prepareFlags(rollbackHelpText)
+	flags.StringVar(&timestamp, "t", "", "")
+	flags.StringVar(&timestamp, "timestamp", "", "")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if len(flags.Args()) != 3 {
+		fmt.Fprint(cli.errStream, rollbackHelpText)
+		return errors.Errorf("want <project> <binary> <version-id>")
+	}
+	if err := validateConfig(); err != nil {
+		return err
+	}
+
+	backend, err := storage.New(cliConfig.BackendEndpoint)
+	if err != nil {
+		return err
+	}
+
+	name, binName, versionID := flags.Arg(0), flags.Arg(1), flags.Arg(2)
+	if timestamp == "" {
+		timestamp, err = backend.LatestTimestamp(cliConfig.BackendEndpoint, name)
+		if err != nil {
+			return err
+		}
+	}
+	u, err := storage.BuildURL(cliConfig.BackendEndpoint, name, timestamp)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile("", "binrep-rollback")
+	if err != nil {
+		return errors.Wrap(err, "failed to create scratch file")
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	if err := backend.PullBinary(tmpFile, u, binName, versionID, 0, ""); err != nil {
+		return err
+	}
+	if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrapf(err, "failed to rewind %v", tmpFile.Name())
+	}
+	bin, err := meta.BuildBinary(tmpFile, binName)
+	if err != nil {
+		return err
+	}
+	if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrapf(err, "failed to rewind %v", tmpFile.Name())
+	}
+
+	_, newVersionID, encryption, err := backend.PushBinary(tmpFile, u, binName, nil)
+	if err != nil {
+		return err
+	}
+	bin.VersionID = newVersionID
+	bin.Encryption = encryption
+	return backend.CreateOrUpdateMeta(u, []*meta.Binary{bin}, nil)
+}
+
+var verifyHelpText = `Usage: binrep verify [options] <host>/<user>/<project>
+
+verify every binary in a release against its recorded checksum and, if
+--trusted-key is given, its signature.
+
+Options:
+  --timestamp, -t       release timestamp (default: latest)
+  --trusted-key		base64-encoded ed25519 public key a binary's signature must verify against (repeatable; env BINREP_TRUSTED_KEYS, comma-separated)
+`
+
+func (cli *CLI) doVerify(args []string) error {
+	var (
+		timestamp   string
+		trustedKeys stringSliceFlag
+	)
+	flags := cli.prepareFlags(verifyHelpText)
+	flags.StringVar(&timestamp, "t", "", "")
+	flags.StringVar(&timestamp, "timestamp", "", "")
+	flags.Var(&trustedKeys, "trusted-key", "")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if len(flags.Args()) != 1 {
+		fmt.Fprint(cli.errStream, verifyHelpText)
+		return errors.Errorf("want <project>")
+	}
+	if err := validateConfig(); err != nil {
+		return err
+	}
+
+	backend, err := storage.New(cliConfig.BackendEndpoint)
+	if err != nil {
+		return err
+	}
+
+	name := flags.Arg(0)
+	if timestamp == "" {
+		timestamp, err = backend.LatestTimestamp(cliConfig.BackendEndpoint, name)
+		if err != nil {
+			return err
+		}
+	}
+	u, err := storage.BuildURL(cliConfig.BackendEndpoint, name, timestamp)
+	if err != nil {
+		return err
+	}
+
+	keys, err := trustedKeys.trustedKeys()
+	if err != nil {
+		return err
+	}
+	if err := backend.VerifyBinaries(u, keys); err != nil {
+		return err
+	}
+	fmt.Fprintf(cli.outStream, "%s: all binaries verified\n", name)
+	return nil
 }
@@ -1,14 +1,14 @@
 package meta
 
 import (
-	"crypto/sha1"
-	"fmt"
+	"crypto/ed25519"
 	"io"
 	"io/ioutil"
 	"time"
 
 	strftime "github.com/jehiah/go-strftime"
 	"github.com/pkg/errors"
+	"github.com/yuuki/binrep/pkg/sign"
 )
 
 type Binary struct {
@@ -16,22 +16,36 @@ type Binary struct {
 	Checksum  string `yaml:"checksum"`
 	Timestamp string `yaml:"timestamp"`
 	Version   string `yaml:"version,omitempty"`
+	// VersionID is the backend-native object version (e.g. an S3 version
+	// ID or a GCS object generation) this binary was pushed as, when the
+	// backend has native versioning enabled. Empty otherwise.
+	VersionID string `yaml:"version_id,omitempty"`
+	// Signature is the base64-encoded detached ed25519 signature of the
+	// binary body, set when pushed with --sign-key.
+	Signature string `yaml:"signature,omitempty"`
+	// Signer is the fingerprint of the key that produced Signature.
+	Signer string `yaml:"signer,omitempty"`
+	// Encryption is the server-side encryption algorithm the backend
+	// applied to this binary (e.g. "AES256", "aws:kms" or "SSE-C"), so
+	// that a puller supplying an SSE-C key knows one is required. The
+	// key itself is never recorded here.
+	Encryption string `yaml:"encryption,omitempty"`
 }
 
 type Meta struct {
 	Binaries []*Binary `yaml:"binaries"`
 }
 
-func New(b *Binary) *Meta {
-	return &Meta{Binaries: []*Binary{b}}
+func New(bins []*Binary) *Meta {
+	return &Meta{Binaries: bins}
 }
 
-func (m *Meta) AppendBinary(b *Binary) {
-	m.Binaries = append(m.Binaries, b)
+func (m *Meta) AppendBinaries(bins []*Binary) {
+	m.Binaries = append(m.Binaries, bins...)
 }
 
 func BuildBinary(r io.Reader, name string) (*Binary, error) {
-	sum, err := checksum(r)
+	sum, err := sign.Checksum(r)
 	if err != nil {
 		return nil, err
 	}
@@ -49,10 +63,25 @@ func now() string {
 	return strftime.Format("%Y%m%d%H%M%S", t)
 }
 
-func checksum(r io.Reader) (string, error) {
+// ValidateChecksum validates the correctness of the checksum. Return
+// error If the both of checksum is not the same.
+func (b *Binary) ValidateChecksum(r io.Reader) error {
+	return sign.ValidateChecksum(b.Checksum, r)
+}
+
+// ValidateSignature validates Signature against the given trusted keys.
+// Return error if the binary is unsigned or the signature does not
+// verify against any of them.
+func (b *Binary) ValidateSignature(trustedKeys []ed25519.PublicKey, r io.Reader) error {
+	if b.Signature == "" {
+		return errors.Errorf("binary %v is not signed", b.Name)
+	}
 	body, err := ioutil.ReadAll(r)
 	if err != nil {
-		errors.Errorf("failed to read data for checksum")
+		return errors.Wrapf(err, "failed to read data for signature verification %v", b.Name)
+	}
+	if err := sign.VerifyAny(trustedKeys, body, b.Signature); err != nil {
+		return errors.Errorf("signature verification failed for %v (signer %v)", b.Name, b.Signer)
 	}
-	return fmt.Sprintf("%x", sha1.Sum(body)), nil
+	return nil
 }
\ No newline at end of file
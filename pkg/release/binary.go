@@ -1,12 +1,13 @@
 package release
 
 import (
-	"crypto/sha256"
+	"crypto/ed25519"
 	"fmt"
 	"io"
 	"io/ioutil"
 
 	"github.com/pkg/errors"
+	"github.com/yuuki/binrep/pkg/sign"
 )
 
 const (
@@ -15,16 +16,18 @@ const (
 
 // Binary represents the binary file within release.
 type Binary struct {
-	Name     string    `yaml:"name"`
-	Checksum string    `yaml:"checksum"`
-	Version  string    `yaml:"version,omitempty"`
-	Body     io.Reader `yaml:"-"`
+	Name      string    `yaml:"name"`
+	Checksum  string    `yaml:"checksum"`
+	Version   string    `yaml:"version,omitempty"`
+	Signature string    `yaml:"signature,omitempty"`
+	Signer    string    `yaml:"signer,omitempty"`
+	Body      io.Reader `yaml:"-"`
 }
 
 // BuildBinary builds a Binary object. Return error if it is failed
 // to calculate checksum of the body.
 func BuildBinary(name string, body io.Reader) (*Binary, error) {
-	sum, err := checksum(body)
+	sum, err := sign.Checksum(body)
 	if err != nil {
 		return nil, err
 	}
@@ -35,23 +38,37 @@ func BuildBinary(name string, body io.Reader) (*Binary, error) {
 	}, nil
 }
 
-func checksum(r io.Reader) (string, error) {
+// ValidateChecksum validates the correctness of the checksum. Return
+// error If the both of checksum is not the same.
+func (b *Binary) ValidateChecksum(r io.Reader) error {
+	return sign.ValidateChecksum(b.Checksum, r)
+}
+
+// Sign signs the binary body with key, populating Signature and Signer.
+// Return error if it is failed to read the body.
+func (b *Binary) Sign(key ed25519.PrivateKey, r io.Reader) error {
 	body, err := ioutil.ReadAll(r)
 	if err != nil {
-		errors.Errorf("failed to read data for checksum")
+		return errors.Wrapf(err, "failed to read data for signing %v", b.Name)
 	}
-	return fmt.Sprintf("%x", sha256.Sum256(body)), nil
+	b.Signature = sign.Sign(key, body)
+	b.Signer = sign.Fingerprint(key.Public().(ed25519.PublicKey))
+	return nil
 }
 
-// ValidateChecksum validates the correctness of the checksum. Return
-// error If the both of checksum is not the same.
-func (b *Binary) ValidateChecksum(r io.Reader) error {
-	sum, err := checksum(r)
+// ValidateSignature validates Signature against the given trusted keys.
+// Return error if the binary is unsigned or the signature does not
+// verify against any of them.
+func (b *Binary) ValidateSignature(trustedKeys []ed25519.PublicKey, r io.Reader) error {
+	if b.Signature == "" {
+		return errors.Errorf("binary %v is not signed", b.Name)
+	}
+	body, err := ioutil.ReadAll(r)
 	if err != nil {
-		return err
+		return errors.Wrapf(err, "failed to read data for signature verification %v", b.Name)
 	}
-	if b.Checksum != sum {
-		return errors.Errorf("invalid checksum, got %v, want %v", sum, b.Checksum)
+	if err := sign.VerifyAny(trustedKeys, body, b.Signature); err != nil {
+		return errors.Errorf("signature verification failed for %v (signer %v)", b.Name, b.Signer)
 	}
 	return nil
 }
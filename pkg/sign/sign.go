@@ -0,0 +1,149 @@
+// Package sign implements detached ed25519 signatures for binrep
+// releases, following the same minisign-style approach used by projects
+// like restic and rclone for supply-chain verification.
+package sign
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+const fingerprintLen = 8
+
+// KeyPair is an ed25519 signing key pair.
+type KeyPair struct {
+	PublicKey  ed25519.PublicKey
+	PrivateKey ed25519.PrivateKey
+}
+
+// GenerateKey generates a new ed25519 key pair.
+func GenerateKey() (*KeyPair, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate signing key")
+	}
+	return &KeyPair{PublicKey: pub, PrivateKey: priv}, nil
+}
+
+// Fingerprint returns a short, stable identifier for a public key,
+// recorded in meta.yml alongside a signature so operators can tell which
+// key produced it without shipping the whole key.
+func Fingerprint(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return base64.RawURLEncoding.EncodeToString(sum[:])[:fingerprintLen]
+}
+
+// Sign signs data with priv, returning the detached signature
+// base64-encoded.
+func Sign(priv ed25519.PrivateKey, data []byte) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(priv, data))
+}
+
+// Verify reports whether signature is a valid detached signature of data
+// for pub. signature must be base64-encoded, as produced by Sign.
+func Verify(pub ed25519.PublicKey, data []byte, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return errors.Wrap(err, "failed to decode signature")
+	}
+	if !ed25519.Verify(pub, data, sig) {
+		return errors.New("signature verification failed")
+	}
+	return nil
+}
+
+// VerifyAny reports whether signature is a valid detached signature of
+// data for any key in trustedKeys. It is the multi-key counterpart of
+// Verify, used to validate a binary against a set of trusted keys rather
+// than a single one.
+func VerifyAny(trustedKeys []ed25519.PublicKey, data []byte, signature string) error {
+	for _, key := range trustedKeys {
+		if Verify(key, data, signature) == nil {
+			return nil
+		}
+	}
+	return errors.New("signature verification failed against all trusted keys")
+}
+
+// Checksum returns the hex-encoded SHA-256 checksum of r's contents. It is
+// shared by pkg/meta and pkg/release so the two Binary types compute and
+// validate checksums identically.
+func Checksum(r io.Reader) (string, error) {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read data for checksum")
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(body)), nil
+}
+
+// ValidateChecksum reports whether r's contents hash to want, returning an
+// error naming both checksums if they differ.
+func ValidateChecksum(want string, r io.Reader) error {
+	got, err := Checksum(r)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return errors.Errorf("invalid checksum, got %v, want %v", got, want)
+	}
+	return nil
+}
+
+// LoadPrivateKey reads an ed25519 private key from a file containing its
+// base64-encoded seed, as written by SavePrivateKey.
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read private key %v", path)
+	}
+	seed, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decode private key %v", path)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.Errorf("invalid private key %v: want %d bytes, got %d", path, ed25519.SeedSize, len(seed))
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// SavePrivateKey writes priv to path as a base64-encoded seed.
+func SavePrivateKey(path string, priv ed25519.PrivateKey) error {
+	seed := base64.StdEncoding.EncodeToString(priv.Seed())
+	if err := ioutil.WriteFile(path, []byte(seed), 0600); err != nil {
+		return errors.Wrapf(err, "failed to write private key %v", path)
+	}
+	return nil
+}
+
+// ParsePublicKey decodes a base64-encoded ed25519 public key, as given to
+// binrep's --trusted-key flag or BINREP_TRUSTED_KEYS.
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode public key")
+	}
+	if len(data) != ed25519.PublicKeySize {
+		return nil, errors.Errorf("invalid public key: want %d bytes, got %d", ed25519.PublicKeySize, len(data))
+	}
+	return ed25519.PublicKey(data), nil
+}
+
+// ParsePublicKeys decodes a set of base64-encoded ed25519 public keys.
+func ParsePublicKeys(ss []string) ([]ed25519.PublicKey, error) {
+	keys := make([]ed25519.PublicKey, 0, len(ss))
+	for _, s := range ss {
+		key, err := ParsePublicKey(s)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,56 @@
+package sign
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+)
+
+func TestSignVerifyRoundTrip(t *testing.T) {
+	kp, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	data := []byte("binrep release body")
+
+	sig := Sign(kp.PrivateKey, data)
+	if err := Verify(kp.PublicKey, data, sig); err != nil {
+		t.Errorf("Verify() error = %v, want nil", err)
+	}
+	if err := Verify(kp.PublicKey, []byte("tampered"), sig); err == nil {
+		t.Error("Verify() with tampered data = nil, want error")
+	}
+}
+
+func TestVerifyAny(t *testing.T) {
+	signer, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	other, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	data := []byte("binrep release body")
+	sig := Sign(signer.PrivateKey, data)
+
+	if err := VerifyAny([]ed25519.PublicKey{other.PublicKey, signer.PublicKey}, data, sig); err != nil {
+		t.Errorf("VerifyAny() error = %v, want nil when one of the trusted keys matches", err)
+	}
+	if err := VerifyAny([]ed25519.PublicKey{other.PublicKey}, data, sig); err == nil {
+		t.Error("VerifyAny() with no matching key = nil, want error")
+	}
+}
+
+func TestValidateChecksum(t *testing.T) {
+	want, err := Checksum(bytes.NewReader([]byte("hello")))
+	if err != nil {
+		t.Fatalf("Checksum() error = %v", err)
+	}
+	if err := ValidateChecksum(want, bytes.NewReader([]byte("hello"))); err != nil {
+		t.Errorf("ValidateChecksum() error = %v, want nil", err)
+	}
+	if err := ValidateChecksum(want, bytes.NewReader([]byte("world"))); err == nil {
+		t.Error("ValidateChecksum() with mismatched data = nil, want error")
+	}
+}
@@ -0,0 +1,413 @@
+package storage
+
+import (
+	"crypto/ed25519"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/yuuki/binrep/pkg/meta"
+	"github.com/yuuki/binrep/pkg/sign"
+)
+
+const (
+	BIN_NAME       = "BINARY"
+	META_FILE_NAME = "meta.yml"
+)
+
+// Version represents a single historical version of a binary, as reported
+// by a backend's native object versioning (e.g. S3 bucket versioning or
+// GCS object generations).
+type Version struct {
+	VersionID string
+	Timestamp time.Time
+}
+
+// ProgressFunc is called after each binary in a PullBinaries call
+// finishes downloading, so a caller can render a multi-bar progress UI.
+type ProgressFunc func(binName string, err error)
+
+// PullOptions configures a PullBinaries call.
+type PullOptions struct {
+	// TrustedKeys, if non-empty, requires every binary to carry a
+	// signature verifying against one of them.
+	TrustedKeys []ed25519.PublicKey
+	// Parallel bounds how many binaries are downloaded concurrently.
+	// <= 0 means runtime.NumCPU().
+	Parallel int
+	// Progress, if set, is called once per binary as it completes.
+	Progress ProgressFunc
+	// SSECustomerKey is the SSE-C key to present when fetching binaries
+	// that were pushed with one (BINREP_SSE_C_KEY). Ignored by backends
+	// that don't support SSE-C.
+	SSECustomerKey string
+}
+
+func (o *PullOptions) parallel() int {
+	if o == nil || o.Parallel <= 0 {
+		return runtime.NumCPU()
+	}
+	return o.Parallel
+}
+
+func (o *PullOptions) trustedKeys() []ed25519.PublicKey {
+	if o == nil {
+		return nil
+	}
+	return o.TrustedKeys
+}
+
+func (o *PullOptions) progress(binName string, err error) {
+	if o != nil && o.Progress != nil {
+		o.Progress(binName, err)
+	}
+}
+
+func (o *PullOptions) sseCustomerKey() string {
+	if o == nil {
+		return ""
+	}
+	return o.SSECustomerKey
+}
+
+// PushOptions configures the server-side encryption applied by a
+// PushBinary call. The zero value leaves objects unencrypted (or subject
+// to whatever default the bucket enforces).
+type PushOptions struct {
+	// ServerSideEncryption is the SSE algorithm to request, e.g.
+	// "AES256" or "aws:kms" (BINREP_SSE). If empty but SSEKMSKeyId is
+	// set, "aws:kms" is assumed.
+	ServerSideEncryption string
+	// SSEKMSKeyId is the KMS key ID or ARN to encrypt with when
+	// ServerSideEncryption is "aws:kms" (BINREP_KMS_KEY_ID).
+	SSEKMSKeyId string
+	// SSECustomerKey is a customer-supplied SSE-C key (BINREP_SSE_C_KEY).
+	// Mutually exclusive with ServerSideEncryption/SSEKMSKeyId.
+	SSECustomerKey string
+}
+
+// algorithm returns the encryption label to record in meta.yml, never the
+// key material itself.
+func (o *PushOptions) algorithm() string {
+	if o == nil {
+		return ""
+	}
+	if o.SSECustomerKey != "" {
+		return "SSE-C"
+	}
+	if o.SSEKMSKeyId != "" {
+		return "aws:kms"
+	}
+	return o.ServerSideEncryption
+}
+
+// Backend represents a storage backend capable of hosting a binrep
+// repository. AWS S3, MinIO (or any other S3-compatible endpoint), Google
+// Cloud Storage and the local filesystem all implement this interface so
+// that the rest of binrep can stay agnostic of where releases actually
+// live.
+type Backend interface {
+	LatestTimestamp(urlStr string, name string) (string, error)
+	// CreateOrUpdateMeta writes bins into meta.yml, creating it if it
+	// doesn't already exist. opts, if non-nil, is applied to meta.yml the
+	// same way it is to the binaries themselves, so metadata isn't left
+	// unencrypted when a backend is configured for SSE.
+	CreateOrUpdateMeta(u *url.URL, bins []*meta.Binary, opts *PushOptions) error
+	// PushBinary pushes the binary data, encrypted per opts, and returns
+	// its storage location, the version ID assigned to it (empty for
+	// backends without native object versioning) and the encryption
+	// algorithm label to record in meta.yml (empty if opts is nil or
+	// left zero).
+	PushBinary(in io.Reader, url *url.URL, binName string, opts *PushOptions) (location, versionID, encryption string, err error)
+	// PullBinary pulls the binary data starting at offset, so an
+	// interrupted download can be resumed by reusing its partial file. If
+	// versionID is non-empty, the backend pulls that specific historical
+	// version instead of the current one; backends without native
+	// versioning return an error when versionID is set. sseCustomerKey
+	// must be supplied when the binary was pushed with an SSE-C key.
+	PullBinary(w io.WriterAt, url *url.URL, binName, versionID string, offset int64, sseCustomerKey string) error
+	// PullBinaries pulls every binary listed in meta.yml into installDir
+	// concurrently, validating each one's checksum (and signature, per
+	// opts.TrustedKeys) before atomically moving it into place. If a
+	// download fails, the binary's partial download is left on disk as
+	// "<name>.part" so a later call can resume it; if its checksum or
+	// signature fails to validate, the ".part" file is removed.
+	PullBinaries(u *url.URL, installDir string, opts *PullOptions) error
+	// VerifyBinaries re-checks the checksum and, if trustedKeys is
+	// non-empty, the signature of every binary listed in meta.yml,
+	// without writing anything to disk.
+	VerifyBinaries(u *url.URL, trustedKeys []ed25519.PublicKey) error
+	// CheckVersioning returns an error if the backend's repository does
+	// not have native object versioning enabled.
+	CheckVersioning(u *url.URL) error
+	// ListVersions lists the historical versions of binName, newest first.
+	ListVersions(u *url.URL, binName string) ([]*Version, error)
+}
+
+// New creates a Backend for the given endpoint. The URL scheme selects
+// the concrete implementation:
+//
+//	s3://bucket/...     AWS S3
+//	minio://host/bucket/... any S3-compatible endpoint (path-style addressing)
+//	gs://bucket/...     Google Cloud Storage
+//	file:///path/...    local filesystem (useful for CI and air-gapped installs)
+func New(endpoint string) (Backend, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse endpoint %v", endpoint)
+	}
+	switch u.Scheme {
+	case "s3", "":
+		return newS3Backend(u)
+	case "minio":
+		return newMinioBackend(u)
+	case "gs":
+		return newGCSBackend(u)
+	case "file":
+		return newFSBackend(u)
+	default:
+		return nil, errors.Errorf("unsupported endpoint scheme %q", u.Scheme)
+	}
+}
+
+// offsetWriterAt adapts an io.WriterAt so that writes for data starting
+// at response byte 0 (as produced by a ranged download starting at
+// offset) land at their true position in the destination file.
+type offsetWriterAt struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (o offsetWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	return o.w.WriteAt(p, off+o.offset)
+}
+
+// sequentialWriter adapts an io.WriterAt into an io.Writer by tracking how
+// many bytes have been written and issuing each WriteAt call at the next
+// position, starting at offset. It lets a backend stream a download via
+// io.CopyBuffer instead of buffering the whole body before a single
+// WriteAt.
+type sequentialWriter struct {
+	w   io.WriterAt
+	pos int64
+}
+
+func newSequentialWriter(w io.WriterAt, offset int64) *sequentialWriter {
+	return &sequentialWriter{w: w, pos: offset}
+}
+
+func (s *sequentialWriter) Write(p []byte) (int, error) {
+	n, err := s.w.WriteAt(p, s.pos)
+	s.pos += int64(n)
+	return n, err
+}
+
+// validateBinary validates the checksum of the data read from r and,
+// when trustedKeys is non-empty, its signature. r must be seekable back
+// to the start between the two checks.
+func validateBinary(bin *meta.Binary, r io.ReadSeeker, trustedKeys []ed25519.PublicKey) error {
+	if err := bin.ValidateChecksum(r); err != nil {
+		return err
+	}
+	if len(trustedKeys) == 0 {
+		return nil
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrapf(err, "failed to rewind %v for signature verification", bin.Name)
+	}
+	return bin.ValidateSignature(trustedKeys, r)
+}
+
+// verifyBinaries downloads each binary in m via pull into a scratch
+// directory, validates it, and removes the directory afterwards. It
+// backs every Backend's VerifyBinaries method, which must not write
+// anything into the caller's installDir. Binaries pushed with an SSE-C
+// key cannot be verified this way, since VerifyBinaries has no way to
+// accept one; such binaries fail with an access-denied error from the
+// backend.
+func verifyBinaries(pull func(w io.WriterAt, binName, versionID string, offset int64, sseCustomerKey string) error, m *meta.Meta, trustedKeys []ed25519.PublicKey) error {
+	tmpDir, err := ioutil.TempDir("", "binrep-verify")
+	if err != nil {
+		return errors.Wrap(err, "failed to create scratch directory")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, bin := range m.Binaries {
+		path := filepath.Join(tmpDir, bin.Name)
+		file, err := os.Create(path)
+		if err != nil {
+			return errors.Wrapf(err, "failed to open %v", path)
+		}
+		if err := pull(file, bin.Name, bin.VersionID, 0, ""); err != nil {
+			file.Close()
+			return err
+		}
+		err = validateBinary(bin, file, trustedKeys)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retryBackoff runs fn, retrying with exponential backoff while
+// isRetryable(err) holds, up to 5 attempts total. This mirrors the retry
+// strategy rclone's S3 backend uses for transient errors like
+// RequestTimeout, SlowDown and 5xx responses.
+func retryBackoff(fn func() error, isRetryable func(error) bool) error {
+	const maxAttempts = 5
+	backoff := 200 * time.Millisecond
+	var err error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt == maxAttempts-1 || !isRetryable(err) {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return err
+}
+
+// pullOne resumes-or-downloads a single binary into
+// installDir/<name>.part, validates it, and atomically renames it into
+// place. Left as ".part" when the download fails so a later call can
+// resume it via offset; removed when validation fails.
+func pullOne(pull func(w io.WriterAt, binName, versionID string, offset int64, sseCustomerKey string) error, isRetryable func(error) bool, bin *meta.Binary, installDir string, trustedKeys []ed25519.PublicKey, sseCustomerKey string) error {
+	finalPath := filepath.Join(installDir, bin.Name)
+	partPath := finalPath + ".part"
+
+	var offset int64
+	if fi, err := os.Stat(partPath); err == nil {
+		offset = fi.Size()
+	}
+	file, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %v", partPath)
+	}
+	err = retryBackoff(func() error {
+		return pull(file, bin.Name, bin.VersionID, offset, sseCustomerKey)
+	}, isRetryable)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return errors.Wrapf(err, "failed to rewind %v", partPath)
+	}
+	err = validateBinary(bin, file, trustedKeys)
+	file.Close()
+	if err != nil {
+		os.Remove(partPath)
+		return err
+	}
+	if err := os.Rename(partPath, finalPath); err != nil {
+		return errors.Wrapf(err, "failed to rename %v to %v", partPath, finalPath)
+	}
+	return nil
+}
+
+// pullBinariesConcurrent downloads every binary in m via pull, bounded by
+// opts.Parallel concurrent workers. It backs every Backend's
+// PullBinaries method.
+func pullBinariesConcurrent(pull func(w io.WriterAt, binName, versionID string, offset int64, sseCustomerKey string) error, isRetryable func(error) bool, m *meta.Meta, installDir string, opts *PullOptions) error {
+	sem := make(chan struct{}, opts.parallel())
+	var wg sync.WaitGroup
+	errs := make([]error, len(m.Binaries))
+	for i, bin := range m.Binaries {
+		i, bin := i, bin
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := pullOne(pull, isRetryable, bin, installDir, opts.trustedKeys(), opts.sseCustomerKey())
+			opts.progress(bin.Name, err)
+			errs[i] = err
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BuildAndPushBinaries builds a meta.Binary for each local file in paths,
+// signs it with signKey if non-nil, and pushes it via push, recording the
+// version ID and encryption label push returns onto the binary before
+// returning every one ready to be passed to CreateOrUpdateMeta. It backs
+// every Backend's push side the way pullBinariesConcurrent backs the pull
+// side.
+func BuildAndPushBinaries(push func(in io.Reader, binName string, opts *PushOptions) (location, versionID, encryption string, err error), paths []string, signKey ed25519.PrivateKey, opts *PushOptions) ([]*meta.Binary, error) {
+	bins := make([]*meta.Binary, 0, len(paths))
+	for _, path := range paths {
+		bin, err := buildAndPushBinary(push, path, signKey, opts)
+		if err != nil {
+			return nil, err
+		}
+		bins = append(bins, bin)
+	}
+	return bins, nil
+}
+
+func buildAndPushBinary(push func(in io.Reader, binName string, opts *PushOptions) (location, versionID, encryption string, err error), path string, signKey ed25519.PrivateKey, opts *PushOptions) (*meta.Binary, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %v", path)
+	}
+	defer file.Close()
+
+	bin, err := meta.BuildBinary(file, filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrapf(err, "failed to rewind %v", path)
+	}
+
+	if signKey != nil {
+		body, err := ioutil.ReadAll(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %v for signing", path)
+		}
+		bin.Signature = sign.Sign(signKey, body)
+		bin.Signer = sign.Fingerprint(signKey.Public().(ed25519.PublicKey))
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, errors.Wrapf(err, "failed to rewind %v", path)
+		}
+	}
+
+	_, versionID, encryption, err := push(file, bin.Name, opts)
+	if err != nil {
+		return nil, err
+	}
+	bin.VersionID = versionID
+	bin.Encryption = encryption
+	return bin, nil
+}
+
+// BuildURL builds the binary file url for the given backend endpoint.
+func BuildURL(urlStr string, name, timestamp string) (*url.URL, error) {
+	//TODO: validate version
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %v", urlStr)
+	}
+	// Join onto the path rather than the raw string, so an endpoint query
+	// such as minio's ?insecure=true stays out of the object path.
+	u.Path = u.Path + "/" + filepath.Join(name, timestamp)
+	return u, nil
+}
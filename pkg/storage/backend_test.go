@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/yuuki/binrep/pkg/meta"
+	"github.com/yuuki/binrep/pkg/sign"
+)
+
+func TestBuildAndPushBinariesAssignsVersionAndEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "binrep-push")
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app")
+	if err := ioutil.WriteFile(path, []byte("binary body"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	push := func(in io.Reader, binName string, opts *PushOptions) (string, string, string, error) {
+		return "mem://" + binName, "v1", opts.algorithm(), nil
+	}
+	opts := &PushOptions{ServerSideEncryption: "AES256"}
+
+	bins, err := BuildAndPushBinaries(push, []string{path}, nil, opts)
+	if err != nil {
+		t.Fatalf("BuildAndPushBinaries() error = %v", err)
+	}
+	if len(bins) != 1 {
+		t.Fatalf("len(bins) = %d, want 1", len(bins))
+	}
+	if bins[0].VersionID != "v1" {
+		t.Errorf("VersionID = %q, want %q", bins[0].VersionID, "v1")
+	}
+	if bins[0].Encryption != "AES256" {
+		t.Errorf("Encryption = %q, want %q", bins[0].Encryption, "AES256")
+	}
+	if bins[0].Signature != "" {
+		t.Errorf("Signature = %q, want empty when no signing key is given", bins[0].Signature)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	attempts := 0
+	err := retryBackoff(func() error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("transient")
+		}
+		return nil
+	}, func(error) bool { return true })
+	if err != nil {
+		t.Fatalf("retryBackoff() error = %v, want nil after retrying", err)
+	}
+	if attempts != 3 {
+		t.Errorf("attempts = %d, want 3", attempts)
+	}
+}
+
+func TestRetryBackoffNotRetryable(t *testing.T) {
+	attempts := 0
+	err := retryBackoff(func() error {
+		attempts++
+		return errors.New("permanent")
+	}, func(error) bool { return false })
+	if err == nil {
+		t.Fatal("retryBackoff() error = nil, want error for a non-retryable failure")
+	}
+	if attempts != 1 {
+		t.Errorf("attempts = %d, want 1 (no retries for a non-retryable error)", attempts)
+	}
+}
+
+func TestPullOneResumesFromPartialDownload(t *testing.T) {
+	content := []byte("hello binrep world")
+	sum, err := sign.Checksum(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("sign.Checksum() error = %v", err)
+	}
+	bin := &meta.Binary{Name: "app", Checksum: sum}
+
+	installDir, err := ioutil.TempDir("", "binrep-pullone")
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(installDir)
+
+	const resumeFrom = 5
+	partPath := filepath.Join(installDir, bin.Name+".part")
+	if err := ioutil.WriteFile(partPath, content[:resumeFrom], 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	var gotOffset int64 = -1
+	pull := func(w io.WriterAt, binName, versionID string, offset int64, sseCustomerKey string) error {
+		gotOffset = offset
+		_, err := w.WriteAt(content[offset:], offset)
+		return err
+	}
+
+	if err := pullOne(pull, func(error) bool { return false }, bin, installDir, nil, ""); err != nil {
+		t.Fatalf("pullOne() error = %v", err)
+	}
+	if gotOffset != resumeFrom {
+		t.Errorf("pull called with offset %d, want %d (resume from the partial file's size)", gotOffset, resumeFrom)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(installDir, bin.Name))
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if string(got) != string(content) {
+		t.Errorf("final file = %q, want %q", got, content)
+	}
+	if _, err := os.Stat(partPath); !os.IsNotExist(err) {
+		t.Errorf(".part file still present after a successful pull")
+	}
+}
@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"crypto/ed25519"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/pkg/errors"
+	"github.com/yuuki/binrep/pkg/meta"
+)
+
+// fsBackend is a Backend backed by the local filesystem, laid out exactly
+// like the S3 backends (.../name/timestamp/<binary> and
+// .../name/timestamp/meta.yml).
+// It is useful for CI and air-gapped installs where no object store is
+// available.
+type fsBackend struct{}
+
+// newFSBackend creates a Backend backed by the local filesystem.
+func newFSBackend(u *url.URL) (Backend, error) {
+	return &fsBackend{}, nil
+}
+
+// root resolves the url to a local filesystem path.
+func (f *fsBackend) root(u *url.URL) string {
+	return filepath.Join(u.Host, u.Path)
+}
+
+// LatestTimestamp gets the latest timestamp.
+func (f *fsBackend) LatestTimestamp(urlStr string, name string) (string, error) {
+	u, err := url.Parse(urlStr + "/" + name)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to parse %v", urlStr)
+	}
+	dir := f.root(u)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", errors.Wrapf(err, "no such projects %v", name)
+	}
+	timestamps := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			timestamps = append(timestamps, e.Name())
+		}
+	}
+	if len(timestamps) < 1 {
+		return "", errors.Errorf("no such projects %v", name)
+	}
+	sort.Strings(timestamps)
+	return timestamps[len(timestamps)-1], nil
+}
+
+// findMeta finds metadata on disk, and returns nil if meta.yml is not found.
+func (f *fsBackend) findMeta(u *url.URL) (*meta.Meta, error) {
+	path := filepath.Join(f.root(u), META_FILE_NAME)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to read %v", path)
+	}
+	var m meta.Meta
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, errors.Wrapf(err, "failed to read %v", path)
+	}
+	return &m, nil
+}
+
+// CreateOrUpdateMeta writes bins into meta.yml. opts is accepted for
+// interface parity but ignored: the local filesystem backend has no
+// encryption to apply to it.
+func (f *fsBackend) CreateOrUpdateMeta(u *url.URL, bins []*meta.Binary, opts *PushOptions) error {
+	m, err := f.findMeta(u)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		m = meta.New(bins)
+	} else {
+		m.AppendBinaries(bins)
+	}
+	data, err := yaml.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal yaml")
+	}
+	dir := f.root(u)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "failed to create %v", dir)
+	}
+	path := filepath.Join(dir, META_FILE_NAME)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return errors.Wrapf(err, "failed to write %v", path)
+	}
+	return nil
+}
+
+// PushBinary pushes the binary file data into the local filesystem. The
+// local filesystem has no native object versioning or encryption, so the
+// returned version ID and encryption label are always empty; opts is
+// ignored.
+func (f *fsBackend) PushBinary(in io.Reader, url *url.URL, binName string, opts *PushOptions) (string, string, string, error) {
+	dir := f.root(url)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", "", "", errors.Wrapf(err, "failed to create %v", dir)
+	}
+	path := filepath.Join(dir, binName)
+	file, err := os.Create(path)
+	if err != nil {
+		return "", "", "", errors.Wrapf(err, "failed to create %v", path)
+	}
+	defer file.Close()
+	if _, err := io.Copy(file, in); err != nil {
+		return "", "", "", errors.Wrapf(err, "failed to write %v", path)
+	}
+	return path, "", "", nil
+}
+
+// PullBinary pulls the binary file data from the local filesystem,
+// starting at offset (for resuming a partial download). sseCustomerKey is
+// ignored: the local filesystem backend has no encryption.
+func (f *fsBackend) PullBinary(w io.WriterAt, u *url.URL, binName, versionID string, offset int64, sseCustomerKey string) error {
+	if versionID != "" {
+		return errors.Errorf("local filesystem backend does not support object versioning")
+	}
+	path := filepath.Join(f.root(u), binName)
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %v", path)
+	}
+	defer file.Close()
+	if offset > 0 {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return errors.Wrapf(err, "failed to seek %v", path)
+		}
+	}
+	buf := make([]byte, 32*1024)
+	if _, err := io.CopyBuffer(newSequentialWriter(w, offset), file, buf); err != nil {
+		return errors.Wrapf(err, "failed to read %v", path)
+	}
+	return nil
+}
+
+// PullBinaries pulls every binary listed in meta.yml into installDir
+// using a bounded worker pool (opts.Parallel, default runtime.NumCPU()).
+func (f *fsBackend) PullBinaries(u *url.URL, installDir string, opts *PullOptions) error {
+	m, err := f.findMeta(u)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return errors.Errorf("meta.yml not found %s", u)
+	}
+	return pullBinariesConcurrent(func(w io.WriterAt, binName, versionID string, offset int64, sseCustomerKey string) error {
+		return f.PullBinary(w, u, binName, versionID, offset, sseCustomerKey)
+	}, func(error) bool { return false }, m, installDir, opts)
+}
+
+// VerifyBinaries re-checks every binary listed in meta.yml without
+// writing anything to installDir.
+func (f *fsBackend) VerifyBinaries(u *url.URL, trustedKeys []ed25519.PublicKey) error {
+	m, err := f.findMeta(u)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return errors.Errorf("meta.yml not found %s", u)
+	}
+	return verifyBinaries(func(w io.WriterAt, binName, versionID string, offset int64, sseCustomerKey string) error {
+		return f.PullBinary(w, u, binName, versionID, offset, sseCustomerKey)
+	}, m, trustedKeys)
+}
+
+// CheckVersioning always fails: the local filesystem backend has no
+// native object versioning.
+func (f *fsBackend) CheckVersioning(u *url.URL) error {
+	return errors.Errorf("local filesystem backend does not support object versioning")
+}
+
+// ListVersions always fails: the local filesystem backend has no native
+// object versioning.
+func (f *fsBackend) ListVersions(u *url.URL, binName string) ([]*Version, error) {
+	return nil, errors.Errorf("local filesystem backend does not support object versioning")
+}
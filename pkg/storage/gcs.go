@@ -0,0 +1,285 @@
+package storage
+
+import (
+	"context"
+	"crypto/ed25519"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	gcs "cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/pkg/errors"
+	"github.com/yuuki/binrep/pkg/meta"
+)
+
+// gcsBackend is a Backend backed by Google Cloud Storage.
+type gcsBackend struct {
+	client *gcs.Client
+	ctx    context.Context
+}
+
+// newGCSBackend creates a Backend backed by Google Cloud Storage.
+func newGCSBackend(u *url.URL) (Backend, error) {
+	ctx := context.Background()
+	client, err := gcs.NewClient(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create gcs client")
+	}
+	return &gcsBackend{client: client, ctx: ctx}, nil
+}
+
+// LatestTimestamp gets the latest timestamp.
+func (g *gcsBackend) LatestTimestamp(urlStr string, name string) (string, error) {
+	u, err := url.Parse(urlStr + "/" + name)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to parse %v", urlStr)
+	}
+	bucket := g.client.Bucket(u.Host)
+	it := bucket.Objects(g.ctx, &gcs.Query{
+		Prefix:    strings.TrimLeft(u.Path, "/") + "/",
+		Delimiter: "/",
+	})
+	var timestamps []string
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to list objects (bucket: %v, path: %v/)", u.Host, u.Path)
+		}
+		if attrs.Prefix != "" {
+			timestamps = append(timestamps, filepath.Base(attrs.Prefix))
+		}
+	}
+	if len(timestamps) < 1 {
+		return "", errors.Errorf("no such projects %v", name)
+	}
+	sort.Strings(timestamps)
+	return timestamps[len(timestamps)-1], nil
+}
+
+// findMeta finds metadata from GCS, and returns nil if meta.yml is not found.
+func (g *gcsBackend) findMeta(u *url.URL) (*meta.Meta, error) {
+	obj := g.client.Bucket(u.Host).Object(filepath.Join(u.Path, META_FILE_NAME))
+	r, err := obj.NewReader(g.ctx)
+	if err != nil {
+		if err == gcs.ErrObjectNotExist {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to get object from gcs %s", u)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read meta.yml on gcs")
+	}
+	var m meta.Meta
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, errors.Wrapf(err, "failed to read meta.yml on gcs")
+	}
+	return &m, nil
+}
+
+func (g *gcsBackend) putMeta(u *url.URL, m *meta.Meta, opts *PushOptions) error {
+	data, err := yaml.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal yaml")
+	}
+	obj := g.client.Bucket(u.Host).Object(filepath.Join(u.Path, META_FILE_NAME))
+	if opts != nil && opts.SSECustomerKey != "" {
+		obj = obj.Key([]byte(opts.SSECustomerKey))
+	}
+	w := obj.NewWriter(g.ctx)
+	if opts != nil && opts.SSEKMSKeyId != "" {
+		w.KMSKeyName = opts.SSEKMSKeyId
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return errors.Wrapf(err, "failed to put meta.yml into gcs (%s)", u)
+	}
+	if err := w.Close(); err != nil {
+		return errors.Wrapf(err, "failed to put meta.yml into gcs (%s)", u)
+	}
+	return nil
+}
+
+func (g *gcsBackend) CreateOrUpdateMeta(u *url.URL, bins []*meta.Binary, opts *PushOptions) error {
+	m, err := g.findMeta(u)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		m = meta.New(bins)
+	} else {
+		m.AppendBinaries(bins)
+	}
+	return g.putMeta(u, m, opts)
+}
+
+// PushBinary pushes the binary file data into GCS. If the bucket has
+// object versioning enabled, the resulting object generation is returned
+// as the version ID. GCS supports customer-supplied encryption keys
+// (opts.SSECustomerKey, via ObjectHandle.Key) and CMEK
+// (opts.SSEKMSKeyId, via Writer.KMSKeyName); opts.ServerSideEncryption
+// has no GCS equivalent and is ignored, so it is not reported in the
+// returned encryption label.
+func (g *gcsBackend) PushBinary(in io.Reader, url *url.URL, binName string, opts *PushOptions) (string, string, string, error) {
+	key := filepath.Join(url.Path, binName)
+	obj := g.client.Bucket(url.Host).Object(key)
+	if opts != nil && opts.SSECustomerKey != "" {
+		obj = obj.Key([]byte(opts.SSECustomerKey))
+	}
+	w := obj.NewWriter(g.ctx)
+	if opts != nil && opts.SSEKMSKeyId != "" {
+		w.KMSKeyName = opts.SSEKMSKeyId
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		w.Close()
+		return "", "", "", errors.Wrapf(err, "failed to upload file to %s", url)
+	}
+	if err := w.Close(); err != nil {
+		return "", "", "", errors.Wrapf(err, "failed to upload file to %s", url)
+	}
+	var versionID string
+	if attrs := w.Attrs(); attrs != nil {
+		versionID = strconv.FormatInt(attrs.Generation, 10)
+	}
+	encryption := opts.algorithm()
+	if opts != nil && opts.SSECustomerKey == "" && opts.SSEKMSKeyId == "" {
+		encryption = ""
+	}
+	return "gs://" + url.Host + "/" + key, versionID, encryption, nil
+}
+
+// PullBinary pulls the binary file data from GCS, starting at offset
+// (for resuming a partial download). If versionID is non-empty, it is
+// treated as an object generation. sseCustomerKey must match the CSEK
+// key the binary was pushed with, if any.
+func (g *gcsBackend) PullBinary(w io.WriterAt, u *url.URL, binName, versionID string, offset int64, sseCustomerKey string) error {
+	obj := g.client.Bucket(u.Host).Object(filepath.Join(u.Path, binName))
+	if versionID != "" {
+		generation, err := strconv.ParseInt(versionID, 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "invalid gcs generation %v", versionID)
+		}
+		obj = obj.Generation(generation)
+	}
+	if sseCustomerKey != "" {
+		obj = obj.Key([]byte(sseCustomerKey))
+	}
+	var r *gcs.Reader
+	var err error
+	if offset > 0 {
+		r, err = obj.NewRangeReader(g.ctx, offset, -1)
+	} else {
+		r, err = obj.NewReader(g.ctx)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to download file from %v", u)
+	}
+	defer r.Close()
+	buf := make([]byte, 32*1024)
+	if _, err := io.CopyBuffer(newSequentialWriter(w, offset), r, buf); err != nil {
+		return errors.Wrapf(err, "failed to download file from %v", u)
+	}
+	return nil
+}
+
+// isRetryableGCSErr reports whether err is a transient GCS error worth
+// retrying, mirroring isRetryableAWSErr's treatment of transient AWS
+// codes: rate limiting and server errors are retried, but permanent
+// failures like 404s and permission errors are not.
+func isRetryableGCSErr(err error) bool {
+	gerr, ok := errors.Cause(err).(*googleapi.Error)
+	if !ok {
+		return false
+	}
+	switch gerr.Code {
+	case 429, 500, 502, 503, 504:
+		return true
+	}
+	return false
+}
+
+// PullBinaries pulls every binary listed in meta.yml into installDir
+// using a bounded worker pool (opts.Parallel, default runtime.NumCPU()).
+func (g *gcsBackend) PullBinaries(u *url.URL, installDir string, opts *PullOptions) error {
+	m, err := g.findMeta(u)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return errors.Errorf("meta.yml not found %s", u)
+	}
+	return pullBinariesConcurrent(func(w io.WriterAt, binName, versionID string, offset int64, sseCustomerKey string) error {
+		return g.PullBinary(w, u, binName, versionID, offset, sseCustomerKey)
+	}, isRetryableGCSErr, m, installDir, opts)
+}
+
+// VerifyBinaries re-checks every binary listed in meta.yml without
+// writing anything to installDir.
+func (g *gcsBackend) VerifyBinaries(u *url.URL, trustedKeys []ed25519.PublicKey) error {
+	m, err := g.findMeta(u)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return errors.Errorf("meta.yml not found %s", u)
+	}
+	return verifyBinaries(func(w io.WriterAt, binName, versionID string, offset int64, sseCustomerKey string) error {
+		return g.PullBinary(w, u, binName, versionID, offset, sseCustomerKey)
+	}, m, trustedKeys)
+}
+
+// CheckVersioning returns an error if the bucket does not have object
+// versioning enabled.
+func (g *gcsBackend) CheckVersioning(u *url.URL) error {
+	attrs, err := g.client.Bucket(u.Host).Attrs(g.ctx)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get bucket attributes for %v", u.Host)
+	}
+	if !attrs.VersioningEnabled {
+		return errors.Errorf("bucket %v does not have versioning enabled", u.Host)
+	}
+	return nil
+}
+
+// ListVersions lists the historical generations of binName, newest first.
+func (g *gcsBackend) ListVersions(u *url.URL, binName string) ([]*Version, error) {
+	key := filepath.Join(u.Path, binName)
+	it := g.client.Bucket(u.Host).Objects(g.ctx, &gcs.Query{
+		Prefix:   key,
+		Versions: true,
+	})
+	var versions []*Version
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list object versions (bucket: %v, key: %v)", u.Host, key)
+		}
+		if attrs.Name != key {
+			continue
+		}
+		versions = append(versions, &Version{
+			VersionID: strconv.FormatInt(attrs.Generation, 10),
+			Timestamp: attrs.Updated,
+		})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Timestamp.After(versions[j].Timestamp)
+	})
+	return versions, nil
+}
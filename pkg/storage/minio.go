@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"net/url"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/errors"
+)
+
+// newMinioBackend creates a Backend for MinIO or any other S3-compatible
+// endpoint, e.g. minio://localhost:9000/mybucket. It reuses the AWS S3
+// implementation verbatim, pointing the AWS SDK at a custom endpoint with
+// path-style addressing, since MinIO speaks the S3 API. The endpoint
+// defaults to https; pass ?insecure=true to talk plain HTTP, as is
+// common for self-hosted MinIO in CI and local dev.
+func newMinioBackend(u *url.URL) (Backend, error) {
+	if u.Host == "" {
+		return nil, errors.Errorf("minio endpoint requires a host, got %s", u)
+	}
+	scheme := "https"
+	if insecure, _ := strconv.ParseBool(u.Query().Get("insecure")); insecure {
+		scheme = "http"
+	}
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(scheme + "://" + u.Host),
+		Region:           aws.String("us-east-1"),
+		S3ForcePathStyle: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create minio session")
+	}
+	return &_s3{
+		svc:        s3.New(sess),
+		uploader:   s3manager.NewUploader(sess),
+		downloader: s3manager.NewDownloader(sess),
+		pathStyle:  true,
+	}, nil
+}
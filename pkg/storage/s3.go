@@ -2,6 +2,11 @@ package storage
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/url"
@@ -23,42 +28,49 @@ import (
 	"github.com/yuuki/binrep/pkg/meta"
 )
 
-const (
-	BIN_NAME       = "BINARY"
-	META_FILE_NAME = "meta.yml"
-)
-
-type S3 interface {
-	LatestTimestamp(urlStr string, name string) (string, error)
-	CreateOrUpdateMeta(u *url.URL, bins []*meta.Binary) error
-	PushBinary(in io.Reader, url *url.URL, binName string) (string, error)
-	PullBinary(w io.WriterAt, url *url.URL, binName string) error
-	PullBinaries(u *url.URL, installDir string) error
-}
-
 type _s3 struct {
 	svc        s3iface.S3API
 	uploader   s3manageriface.UploaderAPI
 	downloader s3manageriface.DownloaderAPI
+
+	// pathStyle is true for S3-compatible endpoints (e.g. MinIO) whose
+	// host is the server address rather than the bucket name, so the
+	// bucket is instead the first element of the URL path.
+	pathStyle bool
 }
 
-// BuildURL builds the binary file url for S3.
-func BuildURL(urlStr string, name, timestamp string) (*url.URL, error) {
-	//TODO: validate version
-	u, err := url.Parse(urlStr + "/" + filepath.Join(name, timestamp))
+// newS3Backend creates a Backend backed by AWS S3.
+func newS3Backend(u *url.URL) (Backend, error) {
+	sess, err := session.NewSession()
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to parse %v", urlStr)
+		return nil, errors.Wrap(err, "failed to create aws session")
 	}
-	return u, nil
-}
-
-// New creates a S3 client object.
-func New(sess *session.Session) S3 {
 	return &_s3{
 		svc:        s3.New(sess),
 		uploader:   s3manager.NewUploader(sess),
 		downloader: s3manager.NewDownloader(sess),
+	}, nil
+}
+
+// bucket resolves the bucket name of u.
+func (s *_s3) bucket(u *url.URL) string {
+	if s.pathStyle {
+		return strings.SplitN(strings.TrimLeft(u.Path, "/"), "/", 2)[0]
 	}
+	return u.Host
+}
+
+// key resolves the object key of u, joined with the given path elements.
+func (s *_s3) key(u *url.URL, elem ...string) string {
+	path := u.Path
+	if s.pathStyle {
+		parts := strings.SplitN(strings.TrimLeft(u.Path, "/"), "/", 2)
+		path = ""
+		if len(parts) > 1 {
+			path = parts[1]
+		}
+	}
+	return filepath.Join(append([]string{path}, elem...)...)
 }
 
 // LatestTimestamp gets the latest timestamp.
@@ -68,8 +80,8 @@ func (s *_s3) LatestTimestamp(urlStr string, name string) (string, error) {
 		return "", errors.Wrapf(err, "failed to parse %v", urlStr)
 	}
 	resp, err := s.svc.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket:    aws.String(u.Host),
-		Prefix:    aws.String(strings.TrimLeft(u.Path, "/") + "/"),
+		Bucket:    aws.String(s.bucket(u)),
+		Prefix:    aws.String(s.key(u) + "/"),
 		Delimiter: aws.String("/"),
 	})
 	if err != nil {
@@ -86,18 +98,32 @@ func (s *_s3) LatestTimestamp(urlStr string, name string) (string, error) {
 	return timestamps[len(timestamps)-1], nil
 }
 
-func (s *_s3) CreateMeta(u *url.URL, bins []*meta.Binary) error {
+func (s *_s3) CreateMeta(u *url.URL, bins []*meta.Binary, opts *PushOptions) error {
 	m := meta.New(bins)
 	data, err := yaml.Marshal(m)
 	if err != nil {
 		return errors.Wrap(err, "failed to marshal yaml")
 	}
-	_, err = s.svc.PutObject(&s3.PutObjectInput{
-		Bucket: aws.String(u.Host),
-		Key:    aws.String(filepath.Join(u.Path, META_FILE_NAME)),
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket(u)),
+		Key:    aws.String(s.key(u, META_FILE_NAME)),
 		Body:   aws.ReadSeekCloser(bytes.NewReader(data)),
-	})
-	if err != nil {
+	}
+	if opts != nil {
+		switch {
+		case opts.SSECustomerKey != "":
+			md5sum := md5.Sum([]byte(opts.SSECustomerKey))
+			input.SSECustomerAlgorithm = aws.String("AES256")
+			input.SSECustomerKey = aws.String(opts.SSECustomerKey)
+			input.SSECustomerKeyMD5 = aws.String(base64.StdEncoding.EncodeToString(md5sum[:]))
+		case opts.SSEKMSKeyId != "":
+			input.ServerSideEncryption = aws.String("aws:kms")
+			input.SSEKMSKeyId = aws.String(opts.SSEKMSKeyId)
+		case opts.ServerSideEncryption != "":
+			input.ServerSideEncryption = aws.String(opts.ServerSideEncryption)
+		}
+	}
+	if _, err := s.svc.PutObject(input); err != nil {
 		return errors.Wrapf(err, "failed to put meta.yml into s3 (%s)", u)
 	}
 	return nil
@@ -106,8 +132,8 @@ func (s *_s3) CreateMeta(u *url.URL, bins []*meta.Binary) error {
 // FindMeta finds metadata from S3, and returns nil if meta.yml is not found.
 func (s *_s3) FindMeta(u *url.URL) (*meta.Meta, error) {
 	resp, err := s.svc.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(u.Host),
-		Key:    aws.String(filepath.Join(u.Path, META_FILE_NAME)),
+		Bucket: aws.String(s.bucket(u)),
+		Key:    aws.String(s.key(u, META_FILE_NAME)),
 	})
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
@@ -130,16 +156,13 @@ func (s *_s3) FindMeta(u *url.URL) (*meta.Meta, error) {
 	return &m, nil
 }
 
-func (s *_s3) CreateOrUpdateMeta(u *url.URL, bins []*meta.Binary) error {
+func (s *_s3) CreateOrUpdateMeta(u *url.URL, bins []*meta.Binary, opts *PushOptions) error {
 	m, err := s.FindMeta(u)
 	if err != nil {
 		return err
 	}
 	if m == nil {
-		if err := s.CreateMeta(u, bins); err != nil {
-			return err
-		}
-		return nil
+		return s.CreateMeta(u, bins, opts)
 	}
 
 	m.AppendBinaries(bins)
@@ -147,44 +170,115 @@ func (s *_s3) CreateOrUpdateMeta(u *url.URL, bins []*meta.Binary) error {
 	if err != nil {
 		return errors.Wrapf(err, "failed to unmsarshal meta")
 	}
-	_, err = s.svc.PutObject(&s3.PutObjectInput{
-		Bucket: aws.String(u.Host),
-		Key:    aws.String(filepath.Join(u.Path, META_FILE_NAME)),
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket(u)),
+		Key:    aws.String(s.key(u, META_FILE_NAME)),
 		Body:   aws.ReadSeekCloser(bytes.NewBuffer(data)),
-	})
-	if err != nil {
+	}
+	if opts != nil {
+		switch {
+		case opts.SSECustomerKey != "":
+			md5sum := md5.Sum([]byte(opts.SSECustomerKey))
+			input.SSECustomerAlgorithm = aws.String("AES256")
+			input.SSECustomerKey = aws.String(opts.SSECustomerKey)
+			input.SSECustomerKeyMD5 = aws.String(base64.StdEncoding.EncodeToString(md5sum[:]))
+		case opts.SSEKMSKeyId != "":
+			input.ServerSideEncryption = aws.String("aws:kms")
+			input.SSEKMSKeyId = aws.String(opts.SSEKMSKeyId)
+		case opts.ServerSideEncryption != "":
+			input.ServerSideEncryption = aws.String(opts.ServerSideEncryption)
+		}
+	}
+	if _, err := s.svc.PutObject(input); err != nil {
 		return errors.Wrap(err, "failed to put meta.yml into s3")
 	}
 
 	return nil
 }
 
-// PushBinary pushes the binary file data into S3.
-func (s *_s3) PushBinary(in io.Reader, url *url.URL, binName string) (string, error) {
-	result, err := s.uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(url.Host),
-		Key:    aws.String(filepath.Join(url.Path, binName)),
+// PushBinary pushes the binary file data into S3, applying the server-side
+// encryption requested by opts, if any.
+func (s *_s3) PushBinary(in io.Reader, url *url.URL, binName string, opts *PushOptions) (string, string, string, error) {
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket(url)),
+		Key:    aws.String(s.key(url, binName)),
 		Body:   in,
-	})
+	}
+	if opts != nil {
+		switch {
+		case opts.SSECustomerKey != "":
+			md5sum := md5.Sum([]byte(opts.SSECustomerKey))
+			input.SSECustomerAlgorithm = aws.String("AES256")
+			input.SSECustomerKey = aws.String(opts.SSECustomerKey)
+			input.SSECustomerKeyMD5 = aws.String(base64.StdEncoding.EncodeToString(md5sum[:]))
+		case opts.SSEKMSKeyId != "":
+			input.ServerSideEncryption = aws.String("aws:kms")
+			input.SSEKMSKeyId = aws.String(opts.SSEKMSKeyId)
+		case opts.ServerSideEncryption != "":
+			input.ServerSideEncryption = aws.String(opts.ServerSideEncryption)
+		}
+	}
+	result, err := s.uploader.Upload(input)
 	if err != nil {
-		return "", errors.Wrapf(err, "failed to upload file to %s", url)
+		return "", "", "", errors.Wrapf(err, "failed to upload file to %s", url)
+	}
+	var versionID string
+	if result.VersionID != nil {
+		versionID = *result.VersionID
 	}
-	return result.Location, nil
+	return result.Location, versionID, opts.algorithm(), nil
 }
 
-// PullBinary pulls the binary file data from S3.
-func (s *_s3) PullBinary(w io.WriterAt, u *url.URL, binName string) error {
-	_, err := s.downloader.Download(w, &s3.GetObjectInput{
-		Bucket: aws.String(u.Host),
-		Key:    aws.String(filepath.Join(u.Path, binName)),
-	})
+// PullBinary pulls the binary file data from S3, starting at offset (for
+// resuming a partial download). If versionID is non-empty, that specific
+// historical version is pulled instead of the current one. sseCustomerKey
+// must match the key the binary was pushed with, if any.
+func (s *_s3) PullBinary(w io.WriterAt, u *url.URL, binName, versionID string, offset int64, sseCustomerKey string) error {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket(u)),
+		Key:    aws.String(s.key(u, binName)),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	if sseCustomerKey != "" {
+		md5sum := md5.Sum([]byte(sseCustomerKey))
+		input.SSECustomerAlgorithm = aws.String("AES256")
+		input.SSECustomerKey = aws.String(sseCustomerKey)
+		input.SSECustomerKeyMD5 = aws.String(base64.StdEncoding.EncodeToString(md5sum[:]))
+	}
+	dest := w
+	if offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+		dest = offsetWriterAt{w: w, offset: offset}
+	}
+	_, err := s.downloader.Download(dest, input)
 	if err != nil {
 		return errors.Wrapf(err, "failed to upload file to %v", u)
 	}
 	return nil
 }
 
-func (s *_s3) PullBinaries(u *url.URL, installDir string) error {
+// isRetryableAWSErr reports whether err is a transient AWS error worth
+// retrying, mirroring the codes rclone's S3 backend treats as transient.
+func isRetryableAWSErr(err error) bool {
+	aerr, ok := errors.Cause(err).(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch aerr.Code() {
+	case "RequestTimeout", "SlowDown", "RequestTimeTooSkewed":
+		return true
+	}
+	if reqErr, ok := aerr.(awserr.RequestFailure); ok && reqErr.StatusCode() >= 500 {
+		return true
+	}
+	return false
+}
+
+// PullBinaries pulls every binary listed in meta.yml into installDir
+// using a bounded worker pool (opts.Parallel, default runtime.NumCPU()).
+func (s *_s3) PullBinaries(u *url.URL, installDir string, opts *PullOptions) error {
 	m, err := s.FindMeta(u)
 	if err != nil {
 		return err
@@ -192,19 +286,68 @@ func (s *_s3) PullBinaries(u *url.URL, installDir string) error {
 	if m == nil {
 		return errors.Errorf("meta.yml not found %s", u)
 	}
-	for _, bin := range m.Binaries {
-		path := filepath.Join(installDir, bin.Name)
-		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
-		if err != nil {
-			return errors.Wrapf(err, "failed to open %v", path)
-		}
-		if err := s.PullBinary(file, u, bin.Name); err != nil {
-			return err
-		}
-		if err := bin.ValidateChecksum(file); err != nil {
-			os.Remove(path)
-			return err
-		}
+	return pullBinariesConcurrent(func(w io.WriterAt, binName, versionID string, offset int64, sseCustomerKey string) error {
+		return s.PullBinary(w, u, binName, versionID, offset, sseCustomerKey)
+	}, isRetryableAWSErr, m, installDir, opts)
+}
+
+// VerifyBinaries re-checks every binary listed in meta.yml without
+// writing anything to installDir.
+func (s *_s3) VerifyBinaries(u *url.URL, trustedKeys []ed25519.PublicKey) error {
+	m, err := s.FindMeta(u)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return errors.Errorf("meta.yml not found %s", u)
+	}
+	return verifyBinaries(func(w io.WriterAt, binName, versionID string, offset int64, sseCustomerKey string) error {
+		return s.PullBinary(w, u, binName, versionID, offset, sseCustomerKey)
+	}, m, trustedKeys)
+}
+
+// CheckVersioning returns an error if the bucket does not have S3
+// versioning enabled.
+func (s *_s3) CheckVersioning(u *url.URL) error {
+	resp, err := s.svc.GetBucketVersioning(&s3.GetBucketVersioningInput{
+		Bucket: aws.String(s.bucket(u)),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to get bucket versioning status for %v", s.bucket(u))
+	}
+	if resp.Status == nil || *resp.Status != s3.BucketVersioningStatusEnabled {
+		return errors.Errorf("bucket %v does not have versioning enabled", s.bucket(u))
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+// ListVersions lists the historical versions of binName, newest first.
+func (s *_s3) ListVersions(u *url.URL, binName string) ([]*Version, error) {
+	key := s.key(u, binName)
+	var versions []*Version
+	err := s.svc.ListObjectVersionsPagesWithContext(context.Background(), &s3.ListObjectVersionsInput{
+		Bucket: aws.String(s.bucket(u)),
+		Prefix: aws.String(key),
+	}, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		for _, v := range page.Versions {
+			// Prefix matches any key starting with key, e.g. "app.old" or
+			// "app-helper" alongside "app"; only the exact object's
+			// history belongs to this binary.
+			if aws.StringValue(v.Key) != key {
+				continue
+			}
+			versions = append(versions, &Version{
+				VersionID: aws.StringValue(v.VersionId),
+				Timestamp: aws.TimeValue(v.LastModified),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list object versions (bucket: %v, key: %v)", s.bucket(u), key)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Timestamp.After(versions[j].Timestamp)
+	})
+	return versions, nil
+}